@@ -0,0 +1,213 @@
+package redirector
+
+import "bufio"
+import "bytes"
+import "errors"
+import "io"
+import "net"
+import "strconv"
+import "strings"
+import "time"
+
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyProtoHeaderTimeout bounds how long Accept will wait for a trusted
+// peer to finish sending its PROXY protocol header. Without it, a stalled
+// trusted connection would block the accept loop indefinitely, since
+// http.Server.Serve calls Accept serially and only hands a connection off
+// to its own goroutine afterwards.
+const proxyProtoHeaderTimeout = 5 * time.Second
+
+// proxyProtoListener wraps a net.Listener, parsing an optional PROXY
+// protocol v1/v2 header off each accepted connection so the real client
+// address is visible to the handler despite sitting behind a TCP load
+// balancer. Connections from peers not in trustedProxies are passed
+// through unmodified, since honouring a PROXY header from an untrusted
+// peer would let it spoof its address.
+type proxyProtoListener struct {
+	net.Listener
+	trustedProxies []net.IPNet
+}
+
+func newProxyProtoListener(l net.Listener, trustedProxies []net.IPNet) *proxyProtoListener {
+	return &proxyProtoListener{Listener: l, trustedProxies: trustedProxies}
+}
+
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	return trustedProxyContains(l.trustedProxies, tcpAddr.IP)
+}
+
+// trustedProxyContains reports whether ip falls within any of proxies. An
+// empty proxies list matches nothing: callers must opt in to trusting a
+// peer by actually naming it in TrustedProxies, rather than getting it for
+// free by leaving the list unset.
+func trustedProxyContains(proxies []net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Accept returns the next connection, having parsed and stripped off any
+// PROXY protocol header sent by a trusted peer. A connection from a trusted
+// peer whose header is stalled, truncated, or malformed is dropped and
+// Accept moves on to the next one, rather than returning an error: a raw
+// error returned from Accept is treated as fatal by http.Server.Serve and
+// would take down the entire listener for everyone else.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !l.isTrusted(c.RemoteAddr()) {
+			return c, nil
+		}
+
+		conn, err := l.readHeader(c)
+		if err != nil {
+			log.Warne(err, "dropping connection with unparsable PROXY protocol header")
+			c.Close()
+			continue
+		}
+
+		return conn, nil
+	}
+}
+
+func (l *proxyProtoListener) readHeader(c net.Conn) (net.Conn, error) {
+	if err := c.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	realAddr, err := readProxyProtoHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return &proxyProtoConn{Conn: c, br: br, realAddr: realAddr}, nil
+}
+
+// proxyProtoConn is a net.Conn whose RemoteAddr has been overridden by a
+// PROXY protocol header, and whose reads are routed through a buffered
+// reader so bytes peeked while parsing the header aren't lost.
+type proxyProtoConn struct {
+	net.Conn
+	br       *bufio.Reader
+	realAddr net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.realAddr != nil {
+		return c.realAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtoHeader reads and parses a PROXY protocol v1 or v2 header
+// from br, returning the client address it carries. If the connection
+// doesn't start with a recognisable PROXY header, it returns a nil address
+// with no error and leaves the unread bytes in br for the caller.
+func readProxyProtoHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyProtoV2Signature))
+	if err == nil && bytes.Equal(sig, proxyProtoV2Signature) {
+		return readProxyProtoV2(br)
+	}
+
+	prefix, err := br.Peek(5)
+	if err != nil || string(prefix) != "PROXY" {
+		return nil, nil
+	}
+
+	return readProxyProtoV1(br)
+}
+
+func readProxyProtoV1(br *bufio.Reader) (net.Addr, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("redirector: malformed PROXY protocol v1 header")
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, errors.New("redirector: malformed PROXY protocol v1 header")
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	srcPort, err := strconv.Atoi(fields[4])
+	if srcIP == nil || err != nil {
+		return nil, errors.New("redirector: malformed PROXY protocol v1 header")
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+func readProxyProtoV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+
+	verCmd := hdr[12]
+	if verCmd>>4 != 2 {
+		return nil, errors.New("redirector: unsupported PROXY protocol version")
+	}
+
+	famProto := hdr[13]
+	addrLen := int(hdr[14])<<8 | int(hdr[15])
+
+	addr := make([]byte, addrLen)
+	if _, err := io.ReadFull(br, addr); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command (e.g. health checks): no address to recover.
+	if verCmd&0x0F == 0 {
+		return nil, nil
+	}
+
+	switch famProto >> 4 {
+	case 1: // AF_INET
+		if len(addr) < 12 {
+			return nil, errors.New("redirector: short PROXY protocol v2 IPv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(addr[0:4]), Port: int(addr[8])<<8 | int(addr[9])}, nil
+	case 2: // AF_INET6
+		if len(addr) < 36 {
+			return nil, errors.New("redirector: short PROXY protocol v2 IPv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(addr[0:16]), Port: int(addr[32])<<8 | int(addr[33])}, nil
+	default:
+		return nil, nil
+	}
+}
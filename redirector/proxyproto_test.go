@@ -0,0 +1,213 @@
+package redirector
+
+import "bufio"
+import "bytes"
+import "net"
+import "testing"
+
+func TestReadProxyProtoV1(t *testing.T) {
+	cases := []struct {
+		name     string
+		line     string
+		wantIP   string
+		wantPort int
+		wantNil  bool
+		wantErr  bool
+	}{
+		{name: "tcp4", line: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", wantIP: "192.0.2.1", wantPort: 56324},
+		{name: "unknown", line: "PROXY UNKNOWN\r\n", wantNil: true},
+		{name: "too few fields", line: "PROXY TCP4 192.0.2.1\r\n", wantErr: true},
+		{name: "bad ip", line: "PROXY TCP4 not-an-ip 192.0.2.2 56324 443\r\n", wantErr: true},
+		{name: "bad port", line: "PROXY TCP4 192.0.2.1 192.0.2.2 not-a-port 443\r\n", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			br := bufio.NewReader(bytes.NewBufferString(c.line))
+			addr, err := readProxyProtoV1(br)
+
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.wantNil {
+				if addr != nil {
+					t.Fatalf("expected a nil address, got %v", addr)
+				}
+				return
+			}
+
+			tcpAddr, ok := addr.(*net.TCPAddr)
+			if !ok {
+				t.Fatalf("expected *net.TCPAddr, got %T", addr)
+			}
+			if tcpAddr.IP.String() != c.wantIP || tcpAddr.Port != c.wantPort {
+				t.Fatalf("got %v, want %s:%d", tcpAddr, c.wantIP, c.wantPort)
+			}
+		})
+	}
+}
+
+func TestReadProxyProtoV2(t *testing.T) {
+	hdr := append([]byte{}, proxyProtoV2Signature...)
+	hdr = append(hdr, 0x21, 0x11, 0x00, 0x0C) // ver/cmd=2/PROXY, fam/proto=AF_INET/STREAM, addrLen=12
+	hdr = append(hdr, net.ParseIP("192.0.2.1").To4()...)
+	hdr = append(hdr, net.ParseIP("192.0.2.2").To4()...)
+	hdr = append(hdr, 0xDC, 0x04) // src port 56324
+	hdr = append(hdr, 0x01, 0xBB) // dst port 443
+
+	br := bufio.NewReader(bytes.NewReader(hdr))
+	addr, err := readProxyProtoV2(br)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("expected *net.TCPAddr, got %T", addr)
+	}
+	if tcpAddr.IP.String() != "192.0.2.1" || tcpAddr.Port != 56324 {
+		t.Fatalf("got %v, want 192.0.2.1:56324", tcpAddr)
+	}
+}
+
+func TestReadProxyProtoV2Local(t *testing.T) {
+	hdr := append([]byte{}, proxyProtoV2Signature...)
+	hdr = append(hdr, 0x20, 0x00, 0x00, 0x00) // ver/cmd=2/LOCAL
+
+	br := bufio.NewReader(bytes.NewReader(hdr))
+	addr, err := readProxyProtoV2(br)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != nil {
+		t.Fatalf("expected a nil address for the LOCAL command, got %v", addr)
+	}
+}
+
+func TestReadProxyProtoV2ShortAddress(t *testing.T) {
+	hdr := append([]byte{}, proxyProtoV2Signature...)
+	hdr = append(hdr, 0x21, 0x11, 0x00, 0x04) // addrLen=4: too short for an IPv4 address+ports
+	hdr = append(hdr, 0x01, 0x02, 0x03, 0x04)
+
+	br := bufio.NewReader(bytes.NewReader(hdr))
+	if _, err := readProxyProtoV2(br); err == nil {
+		t.Fatalf("expected an error for a truncated address block")
+	}
+}
+
+func TestReadProxyProtoHeaderNotPresent(t *testing.T) {
+	br := bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n"))
+	addr, err := readProxyProtoHeader(br)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != nil {
+		t.Fatalf("expected a nil address for a plain HTTP request, got %v", addr)
+	}
+}
+
+func TestProxyProtoListenerUntrustedPassthrough(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	// A CIDR list that doesn't cover the loopback address used by net.Dial
+	// below, so the connection is treated as untrusted.
+	_, untrusted, _ := net.ParseCIDR("203.0.113.0/24")
+	pl := newProxyProtoListener(ln, []net.IPNet{*untrusted})
+
+	go func() {
+		c, dialErr := net.Dial("tcp", ln.Addr().String())
+		if dialErr != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1 2\r\n"))
+		c.Close()
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer c.Close()
+
+	if _, ok := c.(*proxyProtoConn); ok {
+		t.Fatalf("expected an untrusted connection to be passed through unmodified")
+	}
+}
+
+func TestProxyProtoListenerEmptyTrustedProxiesTrustsNobody(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	// No TrustedProxies configured at all: even a peer sending a well-formed
+	// PROXY header must be passed through unmodified rather than trusted by
+	// default, since the deployer never opted any address in.
+	pl := newProxyProtoListener(ln, nil)
+
+	go func() {
+		c, dialErr := net.Dial("tcp", ln.Addr().String())
+		if dialErr != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1 2\r\n"))
+		c.Close()
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer c.Close()
+
+	if _, ok := c.(*proxyProtoConn); ok {
+		t.Fatalf("expected an empty TrustedProxies list to trust nobody, got a rewritten connection")
+	}
+}
+
+func TestProxyProtoListenerSkipsMalformedHeaderFromTrustedPeer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	pl := newProxyProtoListener(ln, []net.IPNet{*all})
+
+	go func() {
+		bad, dialErr := net.Dial("tcp", ln.Addr().String())
+		if dialErr != nil {
+			return
+		}
+		bad.Write([]byte("PROXY GARBAGE\r\n"))
+		bad.Close()
+
+		good, dialErr := net.Dial("tcp", ln.Addr().String())
+		if dialErr != nil {
+			return
+		}
+		good.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		good.Close()
+	}()
+
+	// The malformed header from the first, trusted connection must not
+	// surface as an error out of Accept() or block it from reaching the
+	// second, well-behaved connection.
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("Accept should survive a malformed PROXY header from a trusted peer: %v", err)
+	}
+	c.Close()
+}
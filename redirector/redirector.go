@@ -12,49 +12,191 @@ import "html"
 import "fmt"
 import "gopkg.in/hlandau/service.v2/daemon/chroot"
 import "os"
+import "io/ioutil"
+import "path/filepath"
+import "strings"
+import "context"
 
 var log, Log = xlog.New("acme.redirector")
 
+// ChallengeProvider supplies key authorizations for ACME HTTP-01 challenge
+// tokens. Get returns the key authorization for the given token, and
+// ok=false if the token is not recognised.
+type ChallengeProvider interface {
+	Get(token string) (keyAuth string, ok bool)
+}
+
+// dirChallengeProvider is the default ChallengeProvider, which reads key
+// authorizations from files named after the token in a directory. This is
+// the behaviour redirector has always had.
+type dirChallengeProvider struct {
+	path string
+}
+
+func (p dirChallengeProvider) Get(token string) (string, bool) {
+	if token == "" || strings.ContainsAny(token, "/\\") {
+		return "", false
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(p.path, token))
+	if err != nil {
+		return "", false
+	}
+
+	return string(b), true
+}
+
 type Config struct {
 	Bind          string `default:":80" usage:"Bind address"`
 	ChallengePath string `default:"/var/run/acme/acme-challenge" usage:"Path containing HTTP challenge files"`
+
+	ChallengeBind   string `usage:"If set, bind a separate listener at this address to serve only ACME HTTP-01 challenges, leaving Bind to handle redirects"`
+	DisableRedirect bool   `usage:"Disable the redirect handler entirely, for deployments that only need the HTTP-01 challenge responder"`
+
+	ReadTimeout       time.Duration `default:"0" usage:"Maximum duration for reading the entire request, including the body (0 = no limit)"`
+	ReadHeaderTimeout time.Duration `default:"5s" usage:"Maximum duration for reading the request headers"`
+	WriteTimeout      time.Duration `default:"30s" usage:"Maximum duration before timing out writes of the response"`
+	IdleTimeout       time.Duration `default:"120s" usage:"Maximum amount of time to wait for the next request on a keep-alive connection"`
+	MaxHeaderBytes    int           `default:"16384" usage:"Maximum number of bytes the server will read parsing the request header"`
+
+	CanonicalHost         string        `usage:"If set, requests for any other hostname are redirected straight to this host instead of just switching scheme"`
+	HSTSMaxAge            time.Duration `default:"0" usage:"If nonzero, emit a Strict-Transport-Security header with this max-age on redirects that keep the requested host; redirects to a different CanonicalHost get none"`
+	HSTSIncludeSubdomains bool          `usage:"Add the includeSubDomains directive to the Strict-Transport-Security header"`
+	HSTSPreload           bool          `usage:"Add the preload directive to the Strict-Transport-Security header"`
+
+	// ChallengeProvider, if set, is used to serve ACME HTTP-01 challenge
+	// responses instead of reading them from ChallengePath. This lets
+	// callers hand tokens to the redirector directly rather than writing
+	// them to disk first.
+	ChallengeProvider ChallengeProvider
+
+	ProxyProtocol       bool        `usage:"Accept PROXY protocol v1/v2 headers from TrustedProxies on the redirect listener"`
+	TrustedProxies      []net.IPNet `usage:"Addresses allowed to send PROXY protocol headers"`
+	TrustForwardedProto bool        `usage:"Treat requests from TrustedProxies with X-Forwarded-Proto: https as already secure instead of redirecting them, unless CanonicalHost names a different host"`
 }
 
 type Redirector struct {
-	cfg          Config
+	cfg Config
+
 	httpServer   graceful.Server
 	httpListener net.Listener
-	stopping     uint32
+
+	// challengeServer and challengeListener are only set when cfg.ChallengeBind
+	// names a distinct address, splitting the challenge responder off onto its
+	// own listener instead of sharing httpListener.
+	challengeServer   *graceful.Server
+	challengeListener net.Listener
+
+	stopping uint32
 }
 
-func New(cfg Config) (*Redirector, error) {
-	r := &Redirector{
-		cfg: cfg,
-		httpServer: graceful.Server{
-			Timeout:          100 * time.Millisecond,
-			NoSignalHandling: true,
-			Server: &http.Server{
-				Addr: cfg.Bind,
+func newGracefulServer(addr string, cfg Config) graceful.Server {
+	return graceful.Server{
+		Timeout:          100 * time.Millisecond,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr:              addr,
+			ReadTimeout:       cfg.ReadTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			MaxHeaderBytes:    cfg.MaxHeaderBytes,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, trustedPeerContextKey{}, isConnFromTrustedPeer(cfg, c))
 			},
 		},
 	}
+}
+
+// trustedPeerContextKey is the request context key under which
+// isConnFromTrustedPeer's verdict for a connection is stashed, via
+// http.Server's ConnContext hook, for handlers to read back out.
+type trustedPeerContextKey struct{}
+
+// isConnFromTrustedPeer reports whether c was accepted from an address
+// matching cfg.TrustedProxies. It must be evaluated from the connection's
+// original peer address, before any PROXY protocol rewrite: a *proxyProtoConn
+// already has its RemoteAddr overridden with the address of the client the
+// proxy forwarded on behalf of, not the proxy itself, so that's not usable
+// for a trust decision here — but proxyProtoListener.Accept only ever wraps
+// a connection in proxyProtoConn after confirming its real peer is trusted,
+// so seeing one at all is proof enough.
+func isConnFromTrustedPeer(cfg Config, c net.Conn) bool {
+	if _, ok := c.(*proxyProtoConn); ok {
+		return true
+	}
+
+	tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	return trustedProxyContains(cfg.TrustedProxies, tcpAddr.IP)
+}
+
+// trustedPeerFromContext reports whether the connection a request arrived
+// on was accepted from a trusted peer, as recorded by ConnContext.
+func trustedPeerFromContext(ctx context.Context) bool {
+	trusted, _ := ctx.Value(trustedPeerContextKey{}).(bool)
+	return trusted
+}
+
+func New(cfg Config) (*Redirector, error) {
+	r := &Redirector{cfg: cfg}
 
 	// Try and make the challenge path if it doesn't exist.
-	err := os.MkdirAll(r.cfg.ChallengePath, 0755)
+	err := os.MkdirAll(cfg.ChallengePath, 0755)
 	if err != nil {
 		return nil, err
 	}
 
-	l, err := net.Listen("tcp", r.httpServer.Server.Addr)
-	if err != nil {
-		return nil, err
+	separateChallenge := cfg.ChallengeBind != "" && cfg.ChallengeBind != cfg.Bind
+
+	if !cfg.DisableRedirect || !separateChallenge {
+		r.httpServer = newGracefulServer(cfg.Bind, cfg)
+
+		l, err := net.Listen("tcp", cfg.Bind)
+		if err != nil {
+			return nil, err
+		}
+
+		if cfg.ProxyProtocol {
+			l = newProxyProtoListener(l, cfg.TrustedProxies)
+		}
+
+		r.httpListener = l
 	}
 
-	r.httpListener = l
+	if separateChallenge {
+		s := newGracefulServer(cfg.ChallengeBind, cfg)
+		r.challengeServer = &s
+
+		l, err := net.Listen("tcp", cfg.ChallengeBind)
+		if err != nil {
+			return nil, err
+		}
+
+		r.challengeListener = l
+	}
 
 	return r, nil
 }
 
+// challengeHandler adapts a ChallengeProvider to an http.Handler, serving
+// the key authorization for the token named by the request path.
+func challengeHandler(p ChallengeProvider) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		keyAuth, ok := p.Get(strings.Trim(req.URL.Path, "/"))
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte(keyAuth))
+	})
+}
+
 func (r *Redirector) commonHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		rw.Header().Set("Server", "acmetool-redirector")
@@ -64,37 +206,82 @@ func (r *Redirector) commonHandler(h http.Handler) http.Handler {
 }
 
 func (r *Redirector) Start() error {
-	serveMux := http.NewServeMux()
-	r.httpServer.Handler = r.commonHandler(serveMux)
+	challengeProvider := r.cfg.ChallengeProvider
+	if challengeProvider == nil {
+		challengePath, ok := chroot.Rel(r.cfg.ChallengePath)
+		if !ok {
+			return fmt.Errorf("challenge path is not addressible inside chroot: %s", r.cfg.ChallengePath)
+		}
 
-	challengePath, ok := chroot.Rel(r.cfg.ChallengePath)
-	if !ok {
-		return fmt.Errorf("challenge path is not addressible inside chroot: %s", r.cfg.ChallengePath)
+		challengeProvider = dirChallengeProvider{path: challengePath}
 	}
 
-	serveMux.HandleFunc("/", r.handleRedirect)
-	serveMux.Handle("/.well-known/acme-challenge/",
-		http.StripPrefix("/.well-known/acme-challenge/", http.FileServer(http.Dir(challengePath))))
+	challengeMux := http.NewServeMux()
+	challengeMux.Handle("/.well-known/acme-challenge/",
+		http.StripPrefix("/.well-known/acme-challenge/", challengeHandler(challengeProvider)))
+
+	if r.challengeServer != nil {
+		r.challengeServer.Handler = r.commonHandler(challengeMux)
+		r.serve(r.challengeServer, r.challengeListener)
+	}
+
+	if r.httpListener != nil {
+		// If challenges are being served by a separate listener, this mux only
+		// needs the redirect handler; otherwise it serves both off Bind, as
+		// it always has.
+		mux := challengeMux
+		if r.challengeServer != nil {
+			mux = http.NewServeMux()
+		}
+
+		if !r.cfg.DisableRedirect {
+			mux.HandleFunc("/", r.handleRedirect)
+		}
 
+		r.httpServer.Handler = r.commonHandler(mux)
+		r.serve(&r.httpServer, r.httpListener)
+	}
+
+	return nil
+}
+
+func (r *Redirector) serve(s *graceful.Server, l net.Listener) {
 	go func() {
-		err := r.httpServer.Serve(r.httpListener)
+		err := s.Serve(l)
 		if atomic.LoadUint32(&r.stopping) == 0 {
 			log.Fatale(err, "serve")
 		}
 	}()
-
-	return nil
 }
 
 func (r *Redirector) Stop() error {
 	atomic.StoreUint32(&r.stopping, 1)
-	r.httpServer.Stop(r.httpServer.Timeout)
-	<-r.httpServer.StopChan()
+
+	if r.httpListener != nil {
+		r.httpServer.Stop(r.httpServer.Timeout)
+		<-r.httpServer.StopChan()
+	}
+
+	if r.challengeServer != nil {
+		r.challengeServer.Stop(r.challengeServer.Timeout)
+		<-r.challengeServer.StopChan()
+	}
+
 	return nil
 }
 
+func (r *Redirector) hstsHeaderValue() string {
+	v := fmt.Sprintf("max-age=%d", int(r.cfg.HSTSMaxAge/time.Second))
+	if r.cfg.HSTSIncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if r.cfg.HSTSPreload {
+		v += "; preload"
+	}
+	return v
+}
+
 func (r *Redirector) handleRedirect(rw http.ResponseWriter, req *http.Request) {
-	// Redirect.
 	u := *req.URL
 	u.Scheme = "https"
 	if u.Host == "" {
@@ -105,10 +292,41 @@ func (r *Redirector) handleRedirect(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// If a canonical host has been configured and this request didn't already
+	// target it, redirect straight there instead of just switching scheme, so
+	// we don't force the client through an http->https->canonical-host chain.
+	requestedHost := u.Host
+	if r.cfg.CanonicalHost != "" {
+		u.Host = r.cfg.CanonicalHost
+	}
+
+	// If we're behind a reverse proxy which already terminated TLS and says
+	// so via X-Forwarded-Proto, the request is already secure; only honor
+	// this from a trusted peer, since any direct client could otherwise set
+	// the header itself and skip the redirect. If the request is also
+	// already at the canonical host, there's nothing left to fix, so we can
+	// stop here — but if it arrived at some other host, it still needs
+	// redirecting to the canonical one, just without a scheme change.
+	if r.cfg.TrustForwardedProto && trustedPeerFromContext(req.Context()) &&
+		strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") &&
+		u.Host == requestedHost {
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
 	us := u.String()
 
 	rw.Header().Set("Location", us)
 
+	// The HSTS spec requires the header to be ignored unless it is received
+	// over a connection to the host it names, so only emit it when this
+	// response's target host is the same one the client asked for; otherwise
+	// the host we're sending the client to can set its own HSTS header when
+	// the client gets there.
+	if u.Host == requestedHost && r.cfg.HSTSMaxAge > 0 {
+		rw.Header().Set("Strict-Transport-Security", r.hstsHeaderValue())
+	}
+
 	// If we are receiving any cookies, these must be insecure cookies, ergo
 	// cookies aren't being set securely properly. This is a security issue.
 	// Deleting cookies after the fact doesn't change the fact that they were
@@ -0,0 +1,294 @@
+package redirector
+
+import "context"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+// withTrustedPeer simulates what http.Server's ConnContext hook stashes on
+// a request's context once isConnFromTrustedPeer has run, without needing a
+// real connection.
+func withTrustedPeer(req *http.Request, trusted bool) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), trustedPeerContextKey{}, trusted))
+}
+
+func TestHandleRedirectBasic(t *testing.T) {
+	r := &Redirector{}
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	rw := httptest.NewRecorder()
+
+	r.handleRedirect(rw, req)
+
+	if rw.Code != 308 {
+		t.Fatalf("got status %d, want 308", rw.Code)
+	}
+	if loc := rw.Header().Get("Location"); loc != "https://example.com/foo" {
+		t.Fatalf("got Location %q", loc)
+	}
+	if rw.Header().Get("Strict-Transport-Security") != "" {
+		t.Fatalf("HSTS header must not be set unless HSTSMaxAge is configured")
+	}
+}
+
+func TestHandleRedirectCanonicalHost(t *testing.T) {
+	r := &Redirector{cfg: Config{CanonicalHost: "example.com", HSTSMaxAge: 100 * time.Second}}
+	req := httptest.NewRequest("GET", "http://other.example.com/foo", nil)
+	rw := httptest.NewRecorder()
+
+	r.handleRedirect(rw, req)
+
+	if loc := rw.Header().Get("Location"); loc != "https://example.com/foo" {
+		t.Fatalf("got Location %q", loc)
+	}
+
+	// This response's target host (example.com) differs from the host the
+	// client actually asked for (other.example.com), so HSTS must not be set
+	// here: the spec only lets a host assert HSTS for itself.
+	if rw.Header().Get("Strict-Transport-Security") != "" {
+		t.Fatalf("HSTS header must not be set for a cross-host redirect")
+	}
+}
+
+func TestHandleRedirectHSTSSameHost(t *testing.T) {
+	r := &Redirector{cfg: Config{
+		HSTSMaxAge:            100 * time.Second,
+		HSTSIncludeSubdomains: true,
+		HSTSPreload:           true,
+	}}
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	rw := httptest.NewRecorder()
+
+	r.handleRedirect(rw, req)
+
+	want := "max-age=100; includeSubDomains; preload"
+	if got := rw.Header().Get("Strict-Transport-Security"); got != want {
+		t.Fatalf("got HSTS header %q, want %q", got, want)
+	}
+}
+
+func TestHandleRedirectTrustedForwardedProto(t *testing.T) {
+	r := &Redirector{cfg: Config{TrustForwardedProto: true}}
+
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req = withTrustedPeer(req, true)
+	rw := httptest.NewRecorder()
+
+	r.handleRedirect(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("got status %d from a trusted proxy, want 200", rw.Code)
+	}
+}
+
+func TestHandleRedirectUntrustedForwardedProtoIgnored(t *testing.T) {
+	r := &Redirector{cfg: Config{TrustForwardedProto: true}}
+
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req = withTrustedPeer(req, false)
+	rw := httptest.NewRecorder()
+
+	r.handleRedirect(rw, req)
+
+	if rw.Code != 308 {
+		t.Fatalf("an untrusted peer's X-Forwarded-Proto must not bypass the redirect, got status %d", rw.Code)
+	}
+}
+
+func TestHandleRedirectTrustedForwardedProtoStillRedirectsToCanonicalHost(t *testing.T) {
+	r := &Redirector{cfg: Config{
+		TrustForwardedProto: true,
+		CanonicalHost:       "example.com",
+	}}
+
+	req := httptest.NewRequest("GET", "http://other.example.com/foo", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req = withTrustedPeer(req, true)
+	rw := httptest.NewRecorder()
+
+	r.handleRedirect(rw, req)
+
+	// Already secure, but at the wrong host: must still be redirected to the
+	// canonical host rather than getting a silent 200, just without forcing
+	// another scheme switch.
+	if rw.Code != 308 {
+		t.Fatalf("got status %d, want 308", rw.Code)
+	}
+	if loc := rw.Header().Get("Location"); loc != "https://example.com/foo" {
+		t.Fatalf("got Location %q", loc)
+	}
+}
+
+func TestIsConnFromTrustedPeer(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("203.0.113.0/24")
+	cfg := Config{TrustedProxies: []net.IPNet{*trusted}}
+
+	trustedConn := &fakeConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.5")}}
+	if !isConnFromTrustedPeer(cfg, trustedConn) {
+		t.Fatalf("expected a peer inside TrustedProxies to be trusted")
+	}
+
+	untrustedConn := &fakeConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.7")}}
+	if isConnFromTrustedPeer(cfg, untrustedConn) {
+		t.Fatalf("expected a peer outside TrustedProxies not to be trusted")
+	}
+
+	if isConnFromTrustedPeer(Config{}, trustedConn) {
+		t.Fatalf("expected an empty TrustedProxies list to trust nobody")
+	}
+
+	// A *proxyProtoConn was only ever constructed for a peer that
+	// proxyProtoListener.Accept already confirmed was trusted, so it must be
+	// reported as trusted here even though its RemoteAddr has since been
+	// rewritten to the forwarded client's address, which may not itself be
+	// in TrustedProxies.
+	wrapped := &proxyProtoConn{Conn: untrustedConn, realAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.7")}}
+	if !isConnFromTrustedPeer(cfg, wrapped) {
+		t.Fatalf("expected a proxyProtoConn to be trusted regardless of its rewritten RemoteAddr")
+	}
+}
+
+type fakeConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+type fakeChallengeProvider map[string]string
+
+func (p fakeChallengeProvider) Get(token string) (string, bool) {
+	v, ok := p[token]
+	return v, ok
+}
+
+func TestChallengeHandler(t *testing.T) {
+	h := challengeHandler(fakeChallengeProvider{"tok1": "key1"})
+
+	req := httptest.NewRequest("GET", "/tok1", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "key1" {
+		t.Fatalf("got %d %q, want 200 \"key1\"", rw.Code, rw.Body.String())
+	}
+
+	req2 := httptest.NewRequest("GET", "/missing", nil)
+	rw2 := httptest.NewRecorder()
+	h.ServeHTTP(rw2, req2)
+
+	if rw2.Code != http.StatusNotFound {
+		t.Fatalf("got %d for an unknown token, want 404", rw2.Code)
+	}
+}
+
+func TestDirChallengeProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redirector-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "tok1"), []byte("key1"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	p := dirChallengeProvider{path: dir}
+
+	if v, ok := p.Get("tok1"); !ok || v != "key1" {
+		t.Fatalf("got (%q, %v), want (\"key1\", true)", v, ok)
+	}
+	if _, ok := p.Get("missing"); ok {
+		t.Fatalf("expected an unknown token to be reported missing")
+	}
+	if _, ok := p.Get("../tok1"); ok {
+		t.Fatalf("expected a path-traversal token to be rejected")
+	}
+}
+
+func newTestConfig(t *testing.T) Config {
+	dir, err := ioutil.TempDir("", "redirector-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return Config{
+		Bind:          "127.0.0.1:0",
+		ChallengePath: dir,
+	}
+}
+
+func TestNewPlumbsServerTimeouts(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.ReadHeaderTimeout = 2 * time.Second
+	cfg.WriteTimeout = 3 * time.Second
+	cfg.IdleTimeout = 4 * time.Second
+	cfg.MaxHeaderBytes = 1024
+
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer r.Stop()
+
+	s := r.httpServer.Server
+	if s.ReadHeaderTimeout != 2*time.Second || s.WriteTimeout != 3*time.Second ||
+		s.IdleTimeout != 4*time.Second || s.MaxHeaderBytes != 1024 {
+		t.Fatalf("timeouts not plumbed through to http.Server: %+v", s)
+	}
+}
+
+func TestNewSplitsChallengeListener(t *testing.T) {
+	cfg := newTestConfig(t)
+	// New only splits the listener when ChallengeBind differs from Bind as a
+	// string, so this must not repeat Bind's "127.0.0.1:0".
+	cfg.ChallengeBind = "localhost:0"
+
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer r.Stop()
+
+	if r.httpListener == nil || r.challengeListener == nil {
+		t.Fatalf("expected both a redirect listener and a challenge listener")
+	}
+	if r.httpListener.Addr().String() == r.challengeListener.Addr().String() {
+		t.Fatalf("expected independent bind addresses, both got %s", r.httpListener.Addr())
+	}
+}
+
+func TestNewDisableRedirectWithSplitChallengeSkipsBindListener(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.ChallengeBind = "localhost:0"
+	cfg.DisableRedirect = true
+
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer r.Stop()
+
+	if r.httpListener != nil {
+		t.Fatalf("Bind listener should not be created when redirect is disabled and challenges are split off")
+	}
+	if r.challengeListener == nil {
+		t.Fatalf("expected a challenge listener")
+	}
+}